@@ -0,0 +1,57 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import "time"
+
+// stableConnectionDuration is how long a gRPC stream has to stay up before
+// a subsequent disconnect is treated as a fresh failure rather than a
+// continuation of the same outage, resetting the backoff instead of
+// letting it keep climbing toward its cap.
+const stableConnectionDuration = 1 * time.Minute
+
+// reconnectBackoff produces exponentially increasing delays between gRPC
+// stream reconnect attempts, capped at max. It is not safe for
+// concurrent use.
+type reconnectBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newReconnectBackoff() *reconnectBackoff {
+	return &reconnectBackoff{
+		initial: 1 * time.Second,
+		max:     1 * time.Minute,
+	}
+}
+
+// next returns the next backoff duration and advances the internal state.
+func (b *reconnectBackoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else {
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+	return b.current
+}
+
+// reset brings the backoff back to its initial state, typically called
+// once a reconnect has stayed up long enough to be considered successful.
+func (b *reconnectBackoff) reset() {
+	b.current = 0
+}
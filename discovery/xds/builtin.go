@@ -0,0 +1,85 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+const (
+	// ClusterTypeURL is the CDS resource type URL.
+	ClusterTypeURL = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	// ClusterLoadAssignmentTypeURL is the EDS resource type URL.
+	ClusterLoadAssignmentTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	xdsLabel        = model.MetaLabelPrefix + "xds_"
+	xdsClusterLabel = xdsLabel + "cluster"
+)
+
+func init() {
+	RegisterResourceParser(ClusterTypeURL, parseClusters)
+	RegisterResourceParser(ClusterLoadAssignmentTypeURL, parseClusterLoadAssignments)
+}
+
+// parseClusters is the built-in CDS parser: it synthesizes one pseudo
+// target per cluster carrying only __meta_xds_cluster, the cluster's
+// name. On its own that's only useful as metadata; joined with EDS
+// (see multiFetchDiscovery.join) it enriches every endpoint of a cluster
+// with that label.
+func parseClusters(resources []*anypb.Any, _ string) ([]model.LabelSet, error) {
+	out := make([]model.LabelSet, 0, len(resources))
+	for _, res := range resources {
+		c := &cluster.Cluster{}
+		if err := res.UnmarshalTo(c); err != nil {
+			return nil, fmt.Errorf("unmarshaling Cluster: %w", err)
+		}
+		out = append(out, model.LabelSet{
+			xdsClusterLabel: model.LabelValue(c.GetName()),
+		})
+	}
+	return out, nil
+}
+
+// parseClusterLoadAssignments is the built-in EDS parser: it expands every
+// LbEndpoint of every ClusterLoadAssignment into a target whose
+// __address__ comes from the endpoint's socket address, tagged with the
+// owning cluster's name.
+func parseClusterLoadAssignments(resources []*anypb.Any, _ string) ([]model.LabelSet, error) {
+	var out []model.LabelSet
+	for _, res := range resources {
+		cla := &endpointpb.ClusterLoadAssignment{}
+		if err := res.UnmarshalTo(cla); err != nil {
+			return nil, fmt.Errorf("unmarshaling ClusterLoadAssignment: %w", err)
+		}
+		for _, localityLbEndpoints := range cla.GetEndpoints() {
+			for _, lbEndpoint := range localityLbEndpoints.GetLbEndpoints() {
+				socketAddr := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+				if socketAddr == nil {
+					continue
+				}
+				out = append(out, model.LabelSet{
+					"__address__":   model.LabelValue(fmt.Sprintf("%s:%d", socketAddr.GetAddress(), socketAddr.GetPortValue())),
+					xdsClusterLabel: model.LabelValue(cla.GetClusterName()),
+				})
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// deltaResourceClient abstracts fetching incremental adds/updates/removes
+// for a single xDS resource type over a Delta ADS gRPC stream.
+type deltaResourceClient interface {
+	ResourceTypeURL() string
+	Server() string
+	ID() string
+	Close()
+
+	// FetchDelta blocks until the next DeltaDiscoveryResponse is available,
+	// ctx is cancelled, or an error occurs.
+	FetchDelta(ctx context.Context) (*v3.DeltaDiscoveryResponse, error)
+	// Ack ACKs or NACKs the most recently fetched response.
+	Ack(err error)
+	// Subscribe and Unsubscribe adjust the resource_names_subscribe/
+	// resource_names_unsubscribe fields sent with the next
+	// DeltaDiscoveryRequest, per the delta xDS protocol. An empty
+	// subscription set means "all resources of this type".
+	Subscribe(names ...string)
+	Unsubscribe(names ...string)
+}
+
+// ResourceNamesSubscriber is implemented by discoverers using the delta
+// fetch mode, letting callers narrow or widen the set of resource names
+// requested without restarting the discoverer.
+type ResourceNamesSubscriber interface {
+	ResourceNamesSubscribe(names ...string)
+	ResourceNamesUnsubscribe(names ...string)
+}
+
+// deltaFetchDiscovery implements discovery.Discoverer on top of a
+// deltaResourceClient. It keeps the last-parsed labels for every resource
+// name it has seen so each poll only needs to re-parse the resources that
+// actually changed, while still emitting a single merged targetgroup.Group
+// downstream, same as fetchDiscovery.
+type deltaFetchDiscovery struct {
+	client deltaResourceClient
+
+	source string
+	logger *slog.Logger
+
+	parseResources resourceParser
+	matchLabels    model.LabelSet
+	dropLabels     []model.LabelName
+	metrics        *xdsMetrics
+
+	mu    sync.Mutex
+	cache map[string][]model.LabelSet // resource name -> parsed targets
+}
+
+func newDeltaDiscovery(conf *SDConfig, logger *slog.Logger, metrics *xdsMetrics, typeURL string, parse resourceParser) (discovery.Discoverer, error) {
+	if conf.Transport != TransportGRPC {
+		return nil, errors.New("xds delta fetch mode requires the grpc transport")
+	}
+
+	client, err := newDeltaStreamResourceClient(conf, typeURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating xds delta resource client: %w", err)
+	}
+
+	return &deltaFetchDiscovery{
+		client:         client,
+		source:         conf.Server + "/" + typeURL,
+		logger:         logger,
+		parseResources: parse,
+		matchLabels:    conf.MatchLabels,
+		dropLabels:     conf.DropLabels,
+		metrics:        metrics,
+		cache:          make(map[string][]model.LabelSet),
+	}, nil
+}
+
+// ResourceNamesSubscribe implements ResourceNamesSubscriber.
+func (d *deltaFetchDiscovery) ResourceNamesSubscribe(names ...string) {
+	d.client.Subscribe(names...)
+}
+
+// ResourceNamesUnsubscribe implements ResourceNamesSubscriber.
+func (d *deltaFetchDiscovery) ResourceNamesUnsubscribe(names ...string) {
+	d.client.Unsubscribe(names...)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range names {
+		delete(d.cache, name)
+	}
+}
+
+// Run implements discovery.Discoverer.
+func (d *deltaFetchDiscovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	defer d.client.Close()
+
+	for {
+		if !d.poll(ctx, ch) {
+			return
+		}
+	}
+}
+
+// poll fetches the next delta response, applies it to the cache, and
+// publishes a merged group. It returns false once ctx is done.
+func (d *deltaFetchDiscovery) poll(ctx context.Context, ch chan<- []*targetgroup.Group) bool {
+	start := time.Now()
+	resp, err := d.client.FetchDelta(ctx)
+	if d.metrics != nil {
+		d.metrics.fetchDuration.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		if d.metrics != nil {
+			d.metrics.fetchFailuresCount.Inc()
+		}
+		d.logger.Error("failed to fetch delta xds resources", "typeURL", d.client.ResourceTypeURL(), "err", err)
+		return ctx.Err() == nil
+	}
+
+	applyErr := d.applyDelta(resp)
+	d.client.Ack(applyErr)
+	if applyErr != nil {
+		if d.metrics != nil {
+			d.metrics.fetchFailuresCount.Inc()
+		}
+		d.logger.Error("failed to parse delta xds resources", "typeURL", d.client.ResourceTypeURL(), "err", applyErr)
+		return ctx.Err() == nil
+	}
+
+	d.mu.Lock()
+	targets := make([]model.LabelSet, 0, len(d.cache))
+	for _, ls := range d.cache {
+		targets = append(targets, ls...)
+	}
+	d.mu.Unlock()
+
+	result := []*targetgroup.Group{
+		{
+			Source:  d.source,
+			Targets: filterLabelSets(targets, d.matchLabels, d.dropLabels),
+		},
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- result:
+	}
+	return true
+}
+
+// applyDelta parses the added/updated resources of resp and merges them
+// into the cache, then removes everything in resp.RemovedResources. Only
+// the changed subset is ever re-parsed. Every resource is parsed before
+// any cache mutation happens, so a response that gets NACKed for one bad
+// resource never leaves the good resources in that same response applied
+// — the cache reflects either all of resp or none of it.
+func (d *deltaFetchDiscovery) applyDelta(resp *v3.DeltaDiscoveryResponse) error {
+	updates := make(map[string][]model.LabelSet, len(resp.GetResources()))
+	removals := make(map[string]struct{}, len(resp.GetResources()))
+
+	for _, res := range resp.GetResources() {
+		parsed, err := d.parseResources([]*anypb.Any{res.GetResource()}, resp.GetTypeUrl())
+		if err != nil {
+			return fmt.Errorf("resource %q: %w", res.GetName(), err)
+		}
+		if len(parsed) == 0 {
+			removals[res.GetName()] = struct{}{}
+			continue
+		}
+		updates[res.GetName()] = parsed
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name := range removals {
+		delete(d.cache, name)
+	}
+	for name, ls := range updates {
+		d.cache[name] = ls
+	}
+	for _, name := range resp.GetRemovedResources() {
+		delete(d.cache, name)
+	}
+
+	return nil
+}
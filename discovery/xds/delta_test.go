@@ -0,0 +1,172 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+type testDeltaResourceClient struct {
+	resourceTypeURL string
+	fetch           func(ctx context.Context) (*v3.DeltaDiscoveryResponse, error)
+	subscribed      []string
+	unsubscribed    []string
+}
+
+func (rc *testDeltaResourceClient) ResourceTypeURL() string { return rc.resourceTypeURL }
+func (rc *testDeltaResourceClient) Server() string          { return "" }
+func (rc *testDeltaResourceClient) ID() string              { return "test-client" }
+func (rc *testDeltaResourceClient) Close()                  {}
+func (rc *testDeltaResourceClient) Ack(error)               {}
+
+func (rc *testDeltaResourceClient) FetchDelta(ctx context.Context) (*v3.DeltaDiscoveryResponse, error) {
+	return rc.fetch(ctx)
+}
+
+func (rc *testDeltaResourceClient) Subscribe(names ...string) {
+	rc.subscribed = append(rc.subscribed, names...)
+}
+
+func (rc *testDeltaResourceClient) Unsubscribe(names ...string) {
+	rc.unsubscribed = append(rc.unsubscribed, names...)
+}
+
+// labelSetParser returns a resourceParser that turns every resource into
+// a single-field label set, so applyDelta's per-resource caching can be
+// exercised without a real xDS proto payload.
+func labelSetParser() resourceParser {
+	return func(resources []*anypb.Any, _ string) ([]model.LabelSet, error) {
+		out := make([]model.LabelSet, 0, len(resources))
+		for _, r := range resources {
+			out = append(out, model.LabelSet{"__address__": model.LabelValue(r.GetTypeUrl())})
+		}
+		return out, nil
+	}
+}
+
+func TestDeltaFetchDiscoveryAppliesAddsAndRemoves(t *testing.T) {
+	d := &deltaFetchDiscovery{
+		source:         "test",
+		logger:         nopLogger,
+		parseResources: labelSetParser(),
+		cache:          make(map[string][]model.LabelSet),
+	}
+
+	// First response adds two resources.
+	err := d.applyDelta(&v3.DeltaDiscoveryResponse{
+		Resources: []*v3.Resource{
+			{Name: "a", Resource: &anypb.Any{TypeUrl: "target-a"}},
+			{Name: "b", Resource: &anypb.Any{TypeUrl: "target-b"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, d.cache, 2)
+
+	// Second response removes "a" and updates "b".
+	err = d.applyDelta(&v3.DeltaDiscoveryResponse{
+		Resources: []*v3.Resource{
+			{Name: "b", Resource: &anypb.Any{TypeUrl: "target-b-v2"}},
+		},
+		RemovedResources: []string{"a"},
+	})
+	require.NoError(t, err)
+	require.Len(t, d.cache, 1)
+	require.Equal(t, model.LabelValue("target-b-v2"), d.cache["b"][0]["__address__"])
+}
+
+// multiTargetParser simulates a parser like the built-in EDS one, which
+// expands a single resource into several targets (one per LbEndpoint).
+func multiTargetParser() resourceParser {
+	return func(resources []*anypb.Any, _ string) ([]model.LabelSet, error) {
+		var out []model.LabelSet
+		for _, r := range resources {
+			out = append(out,
+				model.LabelSet{"__address__": model.LabelValue(r.GetTypeUrl() + "-1")},
+				model.LabelSet{"__address__": model.LabelValue(r.GetTypeUrl() + "-2")},
+			)
+		}
+		return out, nil
+	}
+}
+
+func TestDeltaFetchDiscoveryKeepsAllTargetsOfAMultiTargetResource(t *testing.T) {
+	d := &deltaFetchDiscovery{
+		source:         "test",
+		logger:         nopLogger,
+		parseResources: multiTargetParser(),
+		cache:          make(map[string][]model.LabelSet),
+	}
+
+	err := d.applyDelta(&v3.DeltaDiscoveryResponse{
+		Resources: []*v3.Resource{
+			{Name: "cluster-a", Resource: &anypb.Any{TypeUrl: "target-a"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, d.cache["cluster-a"], 2)
+	require.Equal(t, model.LabelValue("target-a-1"), d.cache["cluster-a"][0]["__address__"])
+	require.Equal(t, model.LabelValue("target-a-2"), d.cache["cluster-a"][1]["__address__"])
+}
+
+func TestDeltaFetchDiscoveryPollPublishesMergedGroup(t *testing.T) {
+	calls := 0
+	rc := &testDeltaResourceClient{
+		resourceTypeURL: "test-type",
+		fetch: func(_ context.Context) (*v3.DeltaDiscoveryResponse, error) {
+			calls++
+			if calls == 1 {
+				return &v3.DeltaDiscoveryResponse{
+					Resources: []*v3.Resource{
+						{Name: "a", Resource: &anypb.Any{TypeUrl: "target-a"}},
+					},
+				}, nil
+			}
+			return &v3.DeltaDiscoveryResponse{
+				Resources:        []*v3.Resource{{Name: "c", Resource: &anypb.Any{TypeUrl: "target-c"}}},
+				RemovedResources: []string{"a"},
+			}, nil
+		},
+	}
+
+	d := &deltaFetchDiscovery{
+		client:         rc,
+		source:         "test",
+		logger:         nopLogger,
+		parseResources: labelSetParser(),
+		cache:          make(map[string][]model.LabelSet),
+	}
+
+	ch := make(chan []*targetgroup.Group, 1)
+	ctx := context.Background()
+
+	require.True(t, d.poll(ctx, ch))
+	groups := <-ch
+	require.Len(t, groups, 1)
+	require.Len(t, groups[0].Targets, 1)
+
+	require.True(t, d.poll(ctx, ch))
+	groups = <-ch
+	require.Len(t, groups, 1)
+	require.Len(t, groups[0].Targets, 1)
+	require.Equal(t, model.LabelValue("target-c"), groups[0].Targets[0]["__address__"])
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/config"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// streamResourceClient fetches a single xDS resource type over a long-lived
+// gRPC ADS stream, implementing the ACK/NACK version negotiation required
+// by the streaming xDS protocol: every accepted response is echoed back
+// with its version_info and response_nonce, and every rejected one is
+// NACKed with an error_detail while keeping the last accepted version.
+type streamResourceClient struct {
+	conn    *grpc.ClientConn
+	client  v3.AggregatedDiscoveryServiceClient
+	server  string
+	typeURL string
+	node    *core.Node
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	respCh  chan *v3.DiscoveryResponse
+	errCh   chan error
+	ackedCh chan struct{}
+
+	mu          sync.Mutex
+	stream      v3.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	versionInfo string
+	pendingResp *v3.DiscoveryResponse
+
+	startOnce sync.Once
+}
+
+func newStreamResourceClient(conf *SDConfig, typeURL string) (*streamResourceClient, error) {
+	creds, err := transportCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(conf.Server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("dialing xds server: %w", err)
+	}
+
+	node, err := newNodeProto(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &streamResourceClient{
+		conn:    conn,
+		client:  v3.NewAggregatedDiscoveryServiceClient(conn),
+		server:  conf.Server,
+		typeURL: typeURL,
+		node:    node,
+		ctx:     ctx,
+		cancel:  cancel,
+		respCh:  make(chan *v3.DiscoveryResponse),
+		errCh:   make(chan error, 1),
+		ackedCh: make(chan struct{}),
+	}, nil
+}
+
+func transportCredentials(conf *SDConfig) (credentials.TransportCredentials, error) {
+	if conf.HTTPClientConfig.TLSConfig == (config.TLSConfig{}) {
+		return insecure.NewCredentials(), nil
+	}
+	tlsCfg, err := config.NewTLSConfig(&conf.HTTPClientConfig.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+func (c *streamResourceClient) ResourceTypeURL() string { return c.typeURL }
+func (c *streamResourceClient) Server() string          { return c.server }
+func (c *streamResourceClient) ID() string              { return c.node.GetId() }
+
+func (c *streamResourceClient) Close() {
+	c.cancel()
+	_ = c.conn.Close()
+}
+
+// Fetch starts the background stream on first use, then blocks until the
+// next DiscoveryResponse arrives, ctx is cancelled, or the stream fails.
+func (c *streamResourceClient) Fetch(ctx context.Context) (*v3.DiscoveryResponse, error) {
+	c.startOnce.Do(func() { go c.run() })
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	case err := <-c.errCh:
+		return nil, err
+	case resp := <-c.respCh:
+		return resp, nil
+	}
+}
+
+// Ack reports the outcome of parsing the response most recently returned
+// by Fetch, ACKing or NACKing it on the stream as required by the xDS
+// protocol.
+func (c *streamResourceClient) Ack(parseErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream == nil || c.pendingResp == nil {
+		return
+	}
+
+	req := &v3.DiscoveryRequest{
+		Node:          c.node,
+		TypeUrl:       c.typeURL,
+		ResponseNonce: c.pendingResp.GetNonce(),
+	}
+	if parseErr == nil {
+		c.versionInfo = c.pendingResp.GetVersionInfo()
+		req.VersionInfo = c.versionInfo
+	} else {
+		req.VersionInfo = c.versionInfo
+		req.ErrorDetail = &status.Status{Message: parseErr.Error()}
+	}
+	c.pendingResp = nil
+
+	// Best effort: if the send fails, run() will notice the broken stream
+	// on its next Recv and reconnect, resuming from c.versionInfo.
+	_ = c.stream.Send(req)
+
+	// Release runOnce to call Recv again now that the response it handed
+	// to Fetch has been acked, so a second pendingResp can never overwrite
+	// this one before it's accounted for.
+	select {
+	case c.ackedCh <- struct{}{}:
+	case <-c.ctx.Done():
+	}
+}
+
+// run maintains the ADS stream, reconnecting with exponential backoff, and
+// feeds every response it receives to respCh for Fetch to pick up.
+func (c *streamResourceClient) run() {
+	backoff := newReconnectBackoff()
+	for c.ctx.Err() == nil {
+		connectedAt := time.Now()
+		err := c.runOnce()
+		if time.Since(connectedAt) >= stableConnectionDuration {
+			backoff.reset()
+		}
+		if err != nil {
+			select {
+			case c.errCh <- err:
+			default:
+			}
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff.next()):
+		}
+	}
+}
+
+func (c *streamResourceClient) runOnce() error {
+	stream, err := c.client.StreamAggregatedResources(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.stream = stream
+	versionInfo := c.versionInfo
+	c.mu.Unlock()
+
+	if err := stream.Send(&v3.DiscoveryRequest{
+		Node:        c.node,
+		TypeUrl:     c.typeURL,
+		VersionInfo: versionInfo,
+	}); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			c.mu.Lock()
+			c.stream = nil
+			c.mu.Unlock()
+			return err
+		}
+
+		c.mu.Lock()
+		c.pendingResp = resp
+		c.mu.Unlock()
+
+		select {
+		case c.respCh <- resp:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+
+		// Wait for the consumer's Ack before receiving again, so pendingResp
+		// always reflects the response currently awaiting ACK/NACK.
+		select {
+		case <-c.ackedCh:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
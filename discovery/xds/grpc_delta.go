@@ -0,0 +1,264 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// deltaStreamResourceClient fetches a single xDS resource type over a
+// long-lived Delta ADS gRPC stream, tracking a per-resource version map
+// and the set of subscribed/unsubscribed names to send on the next
+// DeltaDiscoveryRequest.
+type deltaStreamResourceClient struct {
+	conn    *grpc.ClientConn
+	client  v3.AggregatedDiscoveryServiceClient
+	server  string
+	typeURL string
+	node    *core.Node
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	respCh  chan *v3.DeltaDiscoveryResponse
+	errCh   chan error
+	ackedCh chan struct{}
+
+	startOnce sync.Once
+
+	mu               sync.Mutex
+	stream           v3.AggregatedDiscoveryService_DeltaAggregatedResourcesClient
+	resourceVersions map[string]string
+	pendingResp      *v3.DeltaDiscoveryResponse
+	subscribe        []string
+	unsubscribe      []string
+}
+
+func newDeltaStreamResourceClient(conf *SDConfig, typeURL string) (*deltaStreamResourceClient, error) {
+	creds, err := transportCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(conf.Server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("dialing xds server: %w", err)
+	}
+
+	node, err := newNodeProto(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deltaStreamResourceClient{
+		conn:             conn,
+		client:           v3.NewAggregatedDiscoveryServiceClient(conn),
+		server:           conf.Server,
+		typeURL:          typeURL,
+		node:             node,
+		ctx:              ctx,
+		cancel:           cancel,
+		respCh:           make(chan *v3.DeltaDiscoveryResponse),
+		errCh:            make(chan error, 1),
+		ackedCh:          make(chan struct{}),
+		resourceVersions: make(map[string]string),
+	}, nil
+}
+
+func (c *deltaStreamResourceClient) ResourceTypeURL() string { return c.typeURL }
+func (c *deltaStreamResourceClient) Server() string          { return c.server }
+func (c *deltaStreamResourceClient) ID() string              { return c.node.GetId() }
+
+func (c *deltaStreamResourceClient) Close() {
+	c.cancel()
+	_ = c.conn.Close()
+}
+
+// Subscribe queues names to be added to resource_names_subscribe on the
+// next reconnect, and, if the stream is already up, sends them right away
+// so the subscription change takes effect immediately rather than waiting
+// for a reconnect that may never come on a healthy long-lived stream.
+func (c *deltaStreamResourceClient) Subscribe(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribe = append(c.subscribe, names...)
+	c.sendIfConnectedLocked(names, nil)
+}
+
+// Unsubscribe queues names to be added to resource_names_unsubscribe on
+// the next reconnect, and, if the stream is already up, sends them right
+// away for the same reason Subscribe does.
+func (c *deltaStreamResourceClient) Unsubscribe(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribe = append(c.unsubscribe, names...)
+	for _, name := range names {
+		delete(c.resourceVersions, name)
+	}
+	c.sendIfConnectedLocked(nil, names)
+}
+
+// sendIfConnectedLocked sends an incremental DeltaDiscoveryRequest for a
+// Subscribe/Unsubscribe call made while the stream is already up. c.mu
+// must be held by the caller. Best effort: if the send fails, runOnce
+// will notice on its next Recv, reconnect, and resubscribe from the
+// queued names built up in c.subscribe/c.unsubscribe.
+func (c *deltaStreamResourceClient) sendIfConnectedLocked(subscribe, unsubscribe []string) {
+	if c.stream == nil {
+		return
+	}
+	_ = c.stream.Send(&v3.DeltaDiscoveryRequest{
+		Node:                     c.node,
+		TypeUrl:                  c.typeURL,
+		ResourceNamesSubscribe:   subscribe,
+		ResourceNamesUnsubscribe: unsubscribe,
+	})
+}
+
+// FetchDelta starts the background stream on first use, then blocks until
+// the next DeltaDiscoveryResponse arrives, ctx is cancelled, or the stream
+// fails.
+func (c *deltaStreamResourceClient) FetchDelta(ctx context.Context) (*v3.DeltaDiscoveryResponse, error) {
+	c.startOnce.Do(func() { go c.run() })
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	case err := <-c.errCh:
+		return nil, err
+	case resp := <-c.respCh:
+		return resp, nil
+	}
+}
+
+// Ack ACKs or NACKs the most recently fetched response and records the
+// accepted versions of every resource it carried.
+func (c *deltaStreamResourceClient) Ack(parseErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream == nil || c.pendingResp == nil {
+		return
+	}
+
+	req := &v3.DeltaDiscoveryRequest{
+		Node:          c.node,
+		TypeUrl:       c.typeURL,
+		ResponseNonce: c.pendingResp.GetNonce(),
+	}
+	if parseErr == nil {
+		for _, res := range c.pendingResp.GetResources() {
+			c.resourceVersions[res.GetName()] = res.GetVersion()
+		}
+	} else {
+		req.ErrorDetail = &status.Status{Message: parseErr.Error()}
+	}
+	c.pendingResp = nil
+
+	_ = c.stream.Send(req)
+
+	// Release runOnce to call Recv again now that the response it handed
+	// to FetchDelta has been acked, so a second pendingResp can never
+	// overwrite this one before it's accounted for.
+	select {
+	case c.ackedCh <- struct{}{}:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *deltaStreamResourceClient) run() {
+	backoff := newReconnectBackoff()
+	for c.ctx.Err() == nil {
+		connectedAt := time.Now()
+		err := c.runOnce()
+		if time.Since(connectedAt) >= stableConnectionDuration {
+			backoff.reset()
+		}
+		if err != nil {
+			select {
+			case c.errCh <- err:
+			default:
+			}
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff.next()):
+		}
+	}
+}
+
+func (c *deltaStreamResourceClient) runOnce() error {
+	stream, err := c.client.DeltaAggregatedResources(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.stream = stream
+	req := &v3.DeltaDiscoveryRequest{
+		Node:                     c.node,
+		TypeUrl:                  c.typeURL,
+		ResourceNamesSubscribe:   c.subscribe,
+		ResourceNamesUnsubscribe: c.unsubscribe,
+		InitialResourceVersions:  c.resourceVersions,
+	}
+	c.subscribe, c.unsubscribe = nil, nil
+	c.mu.Unlock()
+
+	if err := stream.Send(req); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			c.mu.Lock()
+			c.stream = nil
+			c.mu.Unlock()
+			return err
+		}
+
+		c.mu.Lock()
+		c.pendingResp = resp
+		c.mu.Unlock()
+
+		select {
+		case c.respCh <- resp:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+
+		// Wait for the consumer's Ack before receiving again, so pendingResp
+		// always reflects the response currently awaiting ACK/NACK.
+		select {
+		case <-c.ackedCh:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+const testClusterTypeURL = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+
+var errTestParseFailure = errors.New("test: failed to parse resources")
+
+// fakeADSServer is a minimal in-process Aggregated Discovery Service that
+// replies to every request it receives with the next response from
+// responses, in order, applying ACK/NACK bookkeeping the same way a real
+// control plane would.
+type fakeADSServer struct {
+	v3.UnimplementedAggregatedDiscoveryServiceServer
+
+	responses []*v3.DiscoveryResponse
+	nacks     chan *v3.DiscoveryRequest
+	reqs      chan *v3.DiscoveryRequest
+}
+
+func (s *fakeADSServer) StreamAggregatedResources(stream v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	for _, resp := range s.responses {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if s.reqs != nil {
+			s.reqs <- req
+		}
+		if req.GetErrorDetail() != nil && s.nacks != nil {
+			s.nacks <- req
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	// Drain the final ACK/NACK for the last response sent, then idle until
+	// the client disconnects.
+	req, err := stream.Recv()
+	if err == nil && req.GetErrorDetail() != nil && s.nacks != nil {
+		s.nacks <- req
+	}
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+func dialFakeADSServer(t *testing.T, srv *fakeADSServer) *streamResourceClient {
+	t.Helper()
+	return dialFakeADSServerWithConfig(t, srv, &SDConfig{ClientID: "test-client"})
+}
+
+func dialFakeADSServerWithConfig(t *testing.T, srv *fakeADSServer, conf *SDConfig) *streamResourceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	v3.RegisterAggregatedDiscoveryServiceServer(gs, srv)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+
+	node, err := newNodeProto(conf)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &streamResourceClient{
+		conn:    conn,
+		client:  v3.NewAggregatedDiscoveryServiceClient(conn),
+		server:  "bufconn",
+		typeURL: testClusterTypeURL,
+		node:    node,
+		ctx:     ctx,
+		cancel:  cancel,
+		respCh:  make(chan *v3.DiscoveryResponse),
+		errCh:   make(chan error, 1),
+		ackedCh: make(chan struct{}),
+	}
+}
+
+func TestStreamResourceClientACKsAcceptedResponse(t *testing.T) {
+	srv := &fakeADSServer{
+		responses: []*v3.DiscoveryResponse{
+			{TypeUrl: testClusterTypeURL, VersionInfo: "1", Nonce: "n1"},
+		},
+	}
+	c := dialFakeADSServer(t, srv)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.Fetch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "1", resp.GetVersionInfo())
+
+	c.Ack(nil)
+	require.Equal(t, "1", c.versionInfo)
+}
+
+func TestStreamResourceClientNACKsFailedParse(t *testing.T) {
+	nacks := make(chan *v3.DiscoveryRequest, 1)
+	srv := &fakeADSServer{
+		nacks: nacks,
+		responses: []*v3.DiscoveryResponse{
+			{TypeUrl: testClusterTypeURL, VersionInfo: "1", Nonce: "n1"},
+		},
+	}
+	c := dialFakeADSServer(t, srv)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.Fetch(ctx)
+	require.NoError(t, err)
+
+	c.Ack(errTestParseFailure)
+
+	select {
+	case req := <-nacks:
+		require.NotNil(t, req.GetErrorDetail())
+		require.Empty(t, req.GetVersionInfo())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "expected a NACK request")
+	}
+}
+
+func TestStreamResourceClientSendsNodeMetadataAndLocality(t *testing.T) {
+	reqs := make(chan *v3.DiscoveryRequest, 1)
+	srv := &fakeADSServer{
+		reqs: reqs,
+		responses: []*v3.DiscoveryResponse{
+			{TypeUrl: testClusterTypeURL, VersionInfo: "1", Nonce: "n1"},
+		},
+	}
+
+	conf := &SDConfig{
+		ClientID:     "test-id",
+		NodeMetadata: map[string]string{"cluster": "prod-east"},
+		NodeLocality: NodeLocality{Region: "us-east-1", Zone: "us-east-1a"},
+	}
+	c := dialFakeADSServerWithConfig(t, srv, conf)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.Fetch(ctx)
+	require.NoError(t, err)
+
+	select {
+	case req := <-reqs:
+		require.Equal(t, "test-id", req.GetNode().GetId())
+		require.Contains(t, req.GetNode().GetMetadata().AsMap(), "cluster")
+		require.Equal(t, "prod-east", req.GetNode().GetMetadata().AsMap()["cluster"])
+		require.Equal(t, "us-east-1", req.GetNode().GetLocality().GetRegion())
+		require.Equal(t, "us-east-1a", req.GetNode().GetLocality().GetZone())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "expected a DiscoveryRequest")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/discovery"
+)
+
+var _ discovery.DiscovererMetrics = (*xdsMetrics)(nil)
+
+type xdsMetrics struct {
+	reg            prometheus.Registerer
+	refreshMetrics discovery.RefreshMetricsInstantiator
+
+	fetchFailuresCount   prometheus.Counter
+	fetchSkipUpdateCount prometheus.Counter
+	fetchDuration        prometheus.Histogram
+}
+
+func newDiscovererMetrics(reg prometheus.Registerer, rmi discovery.RefreshMetricsInstantiator) discovery.DiscovererMetrics {
+	return &xdsMetrics{
+		reg:            reg,
+		refreshMetrics: rmi,
+		fetchFailuresCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prometheus",
+			Subsystem: "sd_xds",
+			Name:      "fetch_failures_total",
+			Help:      "The number of xDS resource fetches that failed.",
+		}),
+		fetchSkipUpdateCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prometheus",
+			Subsystem: "sd_xds",
+			Name:      "fetch_skip_updates_total",
+			Help:      "The number of xDS resource fetches that did not result in a change.",
+		}),
+		fetchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "prometheus",
+			Subsystem: "sd_xds",
+			Name:      "fetch_duration_seconds",
+			Help:      "The duration of an xDS resource fetch call.",
+		}),
+	}
+}
+
+// Register implements discovery.DiscovererMetrics.
+func (m *xdsMetrics) Register() error {
+	for _, c := range []prometheus.Collector{m.fetchFailuresCount, m.fetchSkipUpdateCount, m.fetchDuration} {
+		if err := m.reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister implements discovery.DiscovererMetrics.
+func (m *xdsMetrics) Unregister() {
+	m.reg.Unregister(m.fetchFailuresCount)
+	m.reg.Unregister(m.fetchSkipUpdateCount)
+	m.reg.Unregister(m.fetchDuration)
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// multiFetchDiscovery implements discovery.Discoverer over several
+// ResourceClients at once, one per subscribed xDS resource type, using
+// whatever parser is registered for each type URL with
+// RegisterResourceParser. It keeps a per-type cache of the last-seen
+// targets so a fetch of one type doesn't require re-parsing the others,
+// and joins the caches into a single merged set of targets on every
+// update.
+type multiFetchDiscovery struct {
+	clients map[string]ResourceClient
+
+	source string
+	logger *slog.Logger
+
+	matchLabels model.LabelSet
+	dropLabels  []model.LabelName
+
+	refreshInterval time.Duration
+	metrics         *xdsMetrics
+
+	mu    sync.Mutex
+	cache map[string][]model.LabelSet // typeURL -> last-seen targets
+}
+
+// NewDiscoveryMulti creates a discovery.Discoverer that subscribes to
+// every resource type in typeURLs against conf.Server, using the parser
+// registered for each with RegisterResourceParser, and joins the per-type
+// results into a single set of targets — e.g. subscribing to both
+// ClusterTypeURL and ClusterLoadAssignmentTypeURL maps Envoy clusters
+// (CDS) to their endpoints (EDS) in one SD config. metrics is the value
+// returned by SDConfig.NewDiscovererMetrics, already registered by the
+// caller.
+func NewDiscoveryMulti(conf *SDConfig, logger *slog.Logger, metrics discovery.DiscovererMetrics, typeURLs ...string) (discovery.Discoverer, error) {
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	xm, ok := metrics.(*xdsMetrics)
+	if !ok {
+		return nil, fmt.Errorf("invalid discovery metrics type %T", metrics)
+	}
+	if len(typeURLs) == 0 {
+		return nil, errors.New("xds: NewDiscoveryMulti requires at least one resource type URL")
+	}
+	if conf.FetchMode == FetchModeDelta {
+		return nil, errors.New("xds: delta fetch mode is not supported by NewDiscoveryMulti yet")
+	}
+
+	clients := make(map[string]ResourceClient, len(typeURLs))
+	for _, typeURL := range typeURLs {
+		if _, err := lookupResourceParser(typeURL); err != nil {
+			return nil, err
+		}
+		client, err := newResourceClient(conf, typeURL)
+		if err != nil {
+			return nil, fmt.Errorf("creating xds resource client for %q: %w", typeURL, err)
+		}
+		clients[typeURL] = client
+	}
+
+	return &multiFetchDiscovery{
+		clients:         clients,
+		source:          conf.Server,
+		logger:          logger,
+		matchLabels:     conf.MatchLabels,
+		dropLabels:      conf.DropLabels,
+		refreshInterval: time.Duration(conf.RefreshInterval),
+		metrics:         xm,
+		cache:           make(map[string][]model.LabelSet, len(typeURLs)),
+	}, nil
+}
+
+// Run implements discovery.Discoverer.
+func (d *multiFetchDiscovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	defer func() {
+		for _, c := range d.clients {
+			c.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	d.poll(ctx, ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.poll(ctx, ch)
+		}
+	}
+}
+
+func (d *multiFetchDiscovery) poll(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	changed := false
+	for typeURL, client := range d.clients {
+		start := time.Now()
+		resp, err := client.Fetch(ctx)
+		if d.metrics != nil {
+			d.metrics.fetchDuration.Observe(time.Since(start).Seconds())
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			if d.metrics != nil {
+				d.metrics.fetchFailuresCount.Inc()
+			}
+			d.logger.Error("failed to fetch xds resources", "typeURL", typeURL, "err", err)
+			continue
+		}
+		if resp == nil {
+			if d.metrics != nil {
+				d.metrics.fetchSkipUpdateCount.Inc()
+			}
+			continue
+		}
+
+		parse, err := lookupResourceParser(typeURL)
+		if err != nil {
+			d.logger.Error("no parser for xds resource type", "typeURL", typeURL, "err", err)
+			continue
+		}
+
+		targets, parseErr := parse(resp.GetResources(), typeURL)
+		if ackable, ok := client.(ackableResourceClient); ok {
+			ackable.Ack(parseErr)
+		}
+		if parseErr != nil {
+			if d.metrics != nil {
+				d.metrics.fetchFailuresCount.Inc()
+			}
+			d.logger.Error("failed to parse xds resources", "typeURL", typeURL, "err", parseErr)
+			continue
+		}
+
+		d.mu.Lock()
+		d.cache[typeURL] = targets
+		d.mu.Unlock()
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	result := []*targetgroup.Group{
+		{
+			Source:  d.source,
+			Targets: filterLabelSets(d.join(), d.matchLabels, d.dropLabels),
+		},
+	}
+
+	select {
+	case <-ctx.Done():
+	case ch <- result:
+	}
+}
+
+// join merges the per-type caches into a single target list. When both a
+// CDS and an EDS cache are populated, every EDS endpoint is enriched with
+// its cluster's labels (currently just xdsClusterLabel, already present on
+// the endpoint target, but matched here so future CDS-derived labels flow
+// through automatically); targets of any other subscribed type are simply
+// appended. Bare Cluster pseudo-targets carry no __address__, so when EDS
+// is also subscribed they are withheld until its cache has its first
+// response, rather than being emitted as (invalid) scrape targets.
+func (d *multiFetchDiscovery) join() []model.LabelSet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, edsSubscribed := d.clients[ClusterLoadAssignmentTypeURL]
+	clusters, haveClusters := d.cache[ClusterTypeURL]
+	endpoints, haveEndpoints := d.cache[ClusterLoadAssignmentTypeURL]
+
+	var out []model.LabelSet
+	switch {
+	case haveClusters && haveEndpoints:
+		out = append(out, joinByLabel(endpoints, clusters, xdsClusterLabel)...)
+	case haveClusters && !edsSubscribed:
+		out = append(out, clusters...)
+	case haveEndpoints:
+		out = append(out, endpoints...)
+	}
+
+	for typeURL, targets := range d.cache {
+		if typeURL == ClusterTypeURL || typeURL == ClusterLoadAssignmentTypeURL {
+			continue
+		}
+		out = append(out, targets...)
+	}
+	return out
+}
+
+// joinByLabel enriches every label set in base with the labels of the
+// entry in extra whose key label matches, without overwriting any label
+// base already has.
+func joinByLabel(base, extra []model.LabelSet, key model.LabelName) []model.LabelSet {
+	extraByKey := make(map[model.LabelValue]model.LabelSet, len(extra))
+	for _, ls := range extra {
+		if v, ok := ls[key]; ok {
+			extraByKey[v] = ls
+		}
+	}
+
+	out := make([]model.LabelSet, 0, len(base))
+	for _, ls := range base {
+		merged := ls.Clone()
+		if v, ok := ls[key]; ok {
+			if meta, ok := extraByKey[v]; ok {
+				for name, value := range meta {
+					if _, exists := merged[name]; !exists {
+						merged[name] = value
+					}
+				}
+			}
+		}
+		out = append(out, merged)
+	}
+	return out
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinByLabelEnrichesMatchingTargets(t *testing.T) {
+	endpoints := []model.LabelSet{
+		{"__address__": "10.0.0.1:9090", xdsClusterLabel: "web"},
+		{"__address__": "10.0.0.2:9090", xdsClusterLabel: "unknown"},
+	}
+	clusters := []model.LabelSet{
+		{xdsClusterLabel: "web", "__meta_xds_cluster_zone": "us-east-1a"},
+	}
+
+	joined := joinByLabel(endpoints, clusters, xdsClusterLabel)
+	require.Len(t, joined, 2)
+	require.Equal(t, model.LabelValue("us-east-1a"), joined[0]["__meta_xds_cluster_zone"])
+	require.NotContains(t, joined[1], model.LabelName("__meta_xds_cluster_zone"))
+}
+
+func TestMultiFetchDiscoveryJoinsCDSAndEDS(t *testing.T) {
+	d := &multiFetchDiscovery{
+		cache: map[string][]model.LabelSet{
+			ClusterTypeURL: {
+				{xdsClusterLabel: "web"},
+			},
+			ClusterLoadAssignmentTypeURL: {
+				{"__address__": "10.0.0.1:9090", xdsClusterLabel: "web"},
+			},
+		},
+	}
+
+	targets := d.join()
+	require.Len(t, targets, 1)
+	require.Equal(t, model.LabelValue("10.0.0.1:9090"), targets[0]["__address__"])
+}
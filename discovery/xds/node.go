@@ -0,0 +1,78 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// newNodeProto builds the Node message sent with every DiscoveryRequest
+// from conf's ClientID, NodeMetadata and NodeLocality.
+func newNodeProto(conf *SDConfig) (*core.Node, error) {
+	node := &core.Node{Id: conf.ClientID}
+
+	if len(conf.NodeMetadata) > 0 {
+		fields := make(map[string]interface{}, len(conf.NodeMetadata))
+		for k, v := range conf.NodeMetadata {
+			fields[k] = v
+		}
+		meta, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("converting node_metadata: %w", err)
+		}
+		node.Metadata = meta
+	}
+
+	if !conf.NodeLocality.isZero() {
+		node.Locality = &core.Locality{
+			Region:  conf.NodeLocality.Region,
+			Zone:    conf.NodeLocality.Zone,
+			SubZone: conf.NodeLocality.SubZone,
+		}
+	}
+
+	return node, nil
+}
+
+// filterLabelSets applies an optional client-side MatchLabels/DropLabels
+// post-filter to resources parsed from an xDS response, so operators can
+// further prune targets without patching the control plane. A target is
+// kept only if it carries every label in match with a matching value;
+// every label in drop is then removed from the surviving targets.
+func filterLabelSets(targets []model.LabelSet, match model.LabelSet, drop []model.LabelName) []model.LabelSet {
+	if len(match) == 0 && len(drop) == 0 {
+		return targets
+	}
+
+	out := make([]model.LabelSet, 0, len(targets))
+targets:
+	for _, ls := range targets {
+		for name, value := range match {
+			if ls[name] != value {
+				continue targets
+			}
+		}
+		kept := ls.Clone()
+		for _, name := range drop {
+			delete(kept, name)
+		}
+		out = append(out, kept)
+	}
+	return out
+}
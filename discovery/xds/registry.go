@@ -0,0 +1,44 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	parserRegistryMu sync.RWMutex
+	parserRegistry   = map[string]resourceParser{}
+)
+
+// RegisterResourceParser registers the parser used for typeURL by
+// NewDiscoveryMulti, e.g. one of the CDS/EDS/LDS/SDS resource type URLs.
+// Registering under a typeURL that already has a parser replaces it. It is
+// typically called from an init function.
+func RegisterResourceParser(typeURL string, p resourceParser) {
+	parserRegistryMu.Lock()
+	defer parserRegistryMu.Unlock()
+	parserRegistry[typeURL] = p
+}
+
+func lookupResourceParser(typeURL string) (resourceParser, error) {
+	parserRegistryMu.RLock()
+	defer parserRegistryMu.RUnlock()
+	p, ok := parserRegistry[typeURL]
+	if !ok {
+		return nil, fmt.Errorf("no resource parser registered for xds type %q", typeURL)
+	}
+	return p, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/version"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+var userAgent = version.PrometheusUserAgent()
+
+// restResourceClient fetches a single xDS resource type by long-polling the
+// server's REST/JSON endpoint: each request carries the version_info and
+// response_nonce of the last accepted response, and the server replies
+// with either a fresh DiscoveryResponse or a 304 Not Modified once nothing
+// has changed. versionInfo only advances once the caller confirms the
+// response parsed successfully by calling Ack, so a parse failure doesn't
+// strand the client on a version it never actually applied.
+type restResourceClient struct {
+	client  *http.Client
+	url     string
+	typeURL string
+
+	node *core.Node
+
+	mu            sync.Mutex
+	versionInfo   string
+	responseNonce string
+	pendingResp   *v3.DiscoveryResponse
+}
+
+func newRESTResourceClient(conf *SDConfig, typeURL string) (*restResourceClient, error) {
+	client, err := config.NewClientFromConfig(conf.HTTPClientConfig, "xds")
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = time.Duration(conf.FetchTimeout)
+
+	node, err := newNodeProto(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &restResourceClient{
+		client:  client,
+		url:     conf.Server,
+		typeURL: typeURL,
+		node:    node,
+	}, nil
+}
+
+func (c *restResourceClient) ResourceTypeURL() string { return c.typeURL }
+func (c *restResourceClient) Server() string          { return c.url }
+func (c *restResourceClient) ID() string              { return c.node.GetId() }
+func (c *restResourceClient) Close()                  {}
+
+// Fetch sends a DiscoveryRequest carrying the last accepted version_info
+// and response_nonce, and returns the server's response. A 304 response
+// is surfaced as (nil, nil): nothing changed since the last poll.
+func (c *restResourceClient) Fetch(ctx context.Context) (*v3.DiscoveryResponse, error) {
+	c.mu.Lock()
+	req := &v3.DiscoveryRequest{
+		Node:          c.node,
+		TypeUrl:       c.typeURL,
+		VersionInfo:   c.versionInfo,
+		ResponseNonce: c.responseNonce,
+	}
+	c.mu.Unlock()
+
+	body, err := protoJSONMarshalOptions.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling discovery request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("User-Agent", userAgent)
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, httpResp.Body)
+		_ = httpResp.Body.Close()
+	}()
+
+	switch httpResp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status code %d fetching %s from %s", httpResp.StatusCode, c.typeURL, c.url)
+	}
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v3.DiscoveryResponse{}
+	if err := protoJSONUnmarshalOptions.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("unmarshaling discovery response: %w", err)
+	}
+
+	c.mu.Lock()
+	c.pendingResp = resp
+	c.mu.Unlock()
+
+	return resp, nil
+}
+
+// Ack reports the outcome of parsing the response most recently returned by
+// Fetch. The response_nonce always advances so the next request references
+// it, but version_info is only advanced on success, matching the xDS
+// ACK/NACK contract: a rejected version must not be presented as accepted.
+func (c *restResourceClient) Ack(parseErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pendingResp == nil {
+		return
+	}
+	c.responseNonce = c.pendingResp.GetNonce()
+	if parseErr == nil {
+		c.versionInfo = c.pendingResp.GetVersionInfo()
+	}
+	c.pendingResp = nil
+}
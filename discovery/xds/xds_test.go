@@ -297,3 +297,85 @@ func TestPollingDisappearingTargets(t *testing.T) {
 	metrics.Unregister()
 	refreshMetrics.Unregister()
 }
+
+func TestStreamingRunDoesNotWaitForRefreshTicker(t *testing.T) {
+	respCh := make(chan *v3.DiscoveryResponse, 1)
+	rc := &testResourceClient{
+		fetch: func(ctx context.Context) (*v3.DiscoveryResponse, error) {
+			select {
+			case resp := <-respCh:
+				return resp, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+
+	pd := &fetchDiscovery{
+		client:          rc,
+		logger:          nopLogger,
+		parseResources:  constantResourceParser(nil, nil),
+		streaming:       true,
+		refreshInterval: time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []*targetgroup.Group, 1)
+	done := make(chan struct{})
+	go func() {
+		pd.Run(ctx, ch)
+		close(done)
+	}()
+
+	respCh <- &v3.DiscoveryResponse{}
+
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "expected an update without waiting for the refresh ticker")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestRESTResourceClientSendsNodeMetadataAndLocality(t *testing.T) {
+	var gotReq *v3.DiscoveryRequest
+	server := createTestHTTPServer(t, func(request *v3.DiscoveryRequest) (*v3.DiscoveryResponse, error) {
+		gotReq = request
+		return &v3.DiscoveryResponse{VersionInfo: "1", Nonce: "n1"}, nil
+	})
+	defer server.Close()
+
+	conf := sdConf
+	conf.Server = server.URL
+	conf.NodeMetadata = map[string]string{"cluster": "prod-east"}
+	conf.NodeLocality = NodeLocality{Region: "us-east-1", Zone: "us-east-1a"}
+	conf.HTTPClientConfig.TLSConfig.InsecureSkipVerify = true
+
+	client, err := newRESTResourceClient(&conf, "test-type")
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Fetch(context.Background())
+	require.NoError(t, err)
+
+	require.NotNil(t, gotReq)
+	require.Equal(t, "test-id", gotReq.GetNode().GetId())
+	require.Contains(t, gotReq.GetNode().GetMetadata().AsMap(), "cluster")
+	require.Equal(t, "prod-east", gotReq.GetNode().GetMetadata().AsMap()["cluster"])
+	require.Equal(t, "us-east-1", gotReq.GetNode().GetLocality().GetRegion())
+	require.Equal(t, "us-east-1a", gotReq.GetNode().GetLocality().GetZone())
+}
+
+func TestFilterLabelSetsMatchAndDropLabels(t *testing.T) {
+	targets := []model.LabelSet{
+		{"__address__": "10.0.0.1:9090", "env": "prod", "az": "a"},
+		{"__address__": "10.0.0.2:9090", "env": "staging", "az": "a"},
+	}
+
+	filtered := filterLabelSets(targets, model.LabelSet{"env": "prod"}, []model.LabelName{"az"})
+	require.Len(t, filtered, 1)
+	require.Equal(t, model.LabelValue("10.0.0.1:9090"), filtered[0]["__address__"])
+	require.NotContains(t, filtered[0], model.LabelName("az"))
+}